@@ -16,65 +16,69 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"log/slog"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/autoscaling"
-	"github.com/aws/aws-sdk-go/service/autoscaling/autoscalingiface"
 	rgta "github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi"
-	rgtaiface "github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi/resourcegroupstaggingapiiface"
 	"github.com/aws/aws-sdk-go/service/route53"
-	"github.com/aws/aws-sdk-go/service/route53/route53iface"
-	"github.com/coreos/grafiti/arn"
 	"github.com/coreos/grafiti/deleter"
-	"github.com/coreos/grafiti/graph"
+	"github.com/coreos/grafiti/gc"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+	"golang.org/x/time/rate"
+	yaml "gopkg.in/yaml.v2"
 )
 
 var (
-	deleteFile string
-	silent     bool
-	delAllDeps bool
-	wantReport bool
+	deleteFile    string
+	silent        bool
+	delAllDeps    bool
+	wantReport    bool
+	parallel      int
+	rateLimit     float64
+	matchMode     string
+	outputFormat  string
+	regionsFlag   []string
+	profilesFlag  []string
+	purgeVersions bool
 )
 
-// DeleteOrder contains the REVERSE order of deletion for all resource types
-var DeleteOrder = arn.ResourceTypes{
-	arn.EC2VPCRType,
-	arn.EC2VPNGatewayRType, // Deletes EC2 VPN Gateway Attachments
-	arn.EC2SecurityGroupRType,
-	arn.EC2RouteTableRType, // Deletes EC2 Route Table Routes
-	arn.EC2SubnetRType,
-	arn.EC2VolumeRType,
-	arn.EC2CustomerGatewayRType,
-	arn.EC2VPNConnectionRType, // Deletes EC2 VPN Connection Routes
-	arn.EC2NetworkACLRType,
-	arn.EC2NetworkInterfaceRType,
-	arn.EC2InternetGatewayRType,
-	arn.IAMUserRType,
-	arn.IAMRoleRType, // Deletes IAM Role Policies
-	arn.IAMInstanceProfileRType,
-	arn.AutoScalingLaunchConfigurationRType,
-	arn.EC2EIPRType,
-	arn.EC2EIPAssociationRType,
-	arn.EC2NatGatewayRType,
-	arn.ElasticLoadBalancingLoadBalancerRType,
-	arn.AutoScalingGroupRType,
-	arn.EC2InstanceRType,
-	arn.EC2RouteTableAssociationRType,
-	arn.Route53HostedZoneRType, // Deletes Route53 RecordSets
-	arn.S3BucketRType,          // Delete S3 Objects
-}
+// Supported values for --output.
+const (
+	OutputJSON  = "json"
+	OutputYAML  = "yaml"
+	OutputTable = "table"
+)
 
 // TagFileInput holds a list of all tags to be deleted
 type TagFileInput struct {
 	TagFilters []*rgta.TagFilter
+	// MatchMode selects how TagFilters within this entry are combined:
+	// "and" (the default) or "or". When empty, the top-level --match-mode
+	// flag is used instead. See gc.MatchModeAnd / gc.MatchModeOr.
+	MatchMode string
+}
+
+// matchModeFor returns the effective gc.MatchMode for a TagFileInput entry,
+// falling back to the global --match-mode flag value.
+func matchModeFor(t *TagFileInput) gc.MatchMode {
+	if t.MatchMode != "" {
+		return gc.MatchMode(t.MatchMode)
+	}
+	if matchMode != "" {
+		return gc.MatchMode(matchMode)
+	}
+	return gc.MatchModeAnd
 }
 
 func init() {
@@ -83,6 +87,18 @@ func init() {
 	deleteCmd.PersistentFlags().BoolVarP(&silent, "silent", "s", false, "Suppress JSON output.")
 	deleteCmd.PersistentFlags().BoolVar(&delAllDeps, "all-deps", false, "Delete all dependencies of all tagged resourcs.")
 	deleteCmd.PersistentFlags().BoolVar(&wantReport, "report", false, "Pretty-print a report of errors encountered while deleting resources.")
+	deleteCmd.PersistentFlags().IntVar(&parallel, "parallel", 1, "Number of resources to delete concurrently within each deletion stage.")
+	deleteCmd.PersistentFlags().Float64Var(&rateLimit, "rate-limit", 0, "Maximum number of resource deletions started per second across all deletion workers (0 means unlimited). A single deletion may make several AWS API calls; those calls are not limited individually.")
+	deleteCmd.PersistentFlags().StringVar(&matchMode, "match-mode", string(gc.MatchModeAnd), "How to combine a TagFileInput's TagFilters: \"and\" or \"or\". Overridden per-entry by TagFileInput.MatchMode.")
+	deleteCmd.PersistentFlags().StringVar(&outputFormat, "output", OutputJSON, "Output format for the deletion plan and results: json, yaml, or table.")
+	deleteCmd.PersistentFlags().StringSliceVar(&regionsFlag, "regions", nil, "AWS regions to run the scan/delete pipeline in (falls back to the \"region\"/\"regions\" config value).")
+	deleteCmd.PersistentFlags().StringSliceVar(&profilesFlag, "profiles", nil, "AWS credential profiles to run the scan/delete pipeline as (falls back to the \"profiles\" config value, then the default profile).")
+	deleteCmd.PersistentFlags().BoolVar(&purgeVersions, "purge-versions", false, "Before deleting an S3 bucket, purge all object versions (current and non-current) and delete markers. Required for versioned buckets, a no-op otherwise.")
+	viper.BindPFlag("purgeVersions", deleteCmd.PersistentFlags().Lookup("purge-versions"))
+	viper.BindPFlag("parallel", deleteCmd.PersistentFlags().Lookup("parallel"))
+	viper.BindPFlag("rateLimit", deleteCmd.PersistentFlags().Lookup("rate-limit"))
+	viper.BindPFlag("regions", deleteCmd.PersistentFlags().Lookup("regions"))
+	viper.BindPFlag("profiles", deleteCmd.PersistentFlags().Lookup("profiles"))
 }
 
 var deleteCmd = &cobra.Command{
@@ -92,400 +108,224 @@ var deleteCmd = &cobra.Command{
 	RunE:  runDeleteCommand,
 }
 
+// runDeleteCommand is a thin CLI shim: it parses the delete file, fans the
+// resulting filters out across every (profile, region) pair, and drives a
+// gc.Reconciler per pair. All resource resolution and deletion logic lives
+// in package gc so it can be reused outside the CLI.
 func runDeleteCommand(cmd *cobra.Command, args []string) error {
+	var (
+		data []byte
+		err  error
+	)
 	if deleteFile != "" {
-		return deleteFromFile(deleteFile)
-	}
-	if err := deleteFromStdIn(); err != nil {
-		return err
+		data, err = ioutil.ReadFile(deleteFile)
+	} else {
+		data, err = ioutil.ReadAll(os.Stdin)
 	}
-	return nil
-}
-
-func deleteFromFile(fname string) error {
-	file, err := os.Open(fname)
 	if err != nil {
 		return err
 	}
-	defer file.Close()
-
-	reader := bufio.NewReader(file)
-	return deleteFromTags(reader)
-}
-
-func deleteFromStdIn() error {
-	return deleteFromTags(os.Stdin)
-}
-
-func deleteFromTags(reader io.Reader) error {
-	dec := json.NewDecoder(reader)
-	// Collect all ARN's
-	allARNs := make(arn.ResourceARNs, 0)
-
-	svc := rgta.New(session.Must(session.NewSession(
-		&aws.Config{
-			Region: aws.String(viper.GetString("region")),
-		},
-	)))
 
-	for {
-		t, isEOF, err := decodeTagFileInput(dec)
-		if err != nil {
-			return err
-		}
-		if isEOF {
-			break
-		}
-		if t == nil {
-			continue
-		}
+	regions := effectiveRegions()
+	profiles := effectiveProfiles()
 
-		allARNs = getARNsForResource(svc, t.TagFilters, allARNs)
+	var runErrs []string
+	var runLogs []runLog
+	for _, profile := range profiles {
+		for _, region := range regions {
+			sess := session.Must(session.NewSessionWithOptions(session.Options{
+				Profile: profile,
+				Config:  aws.Config{Region: aws.String(region)},
+			}))
 
-		for rtk := range arn.RGTAUnsupportedResourceTypes {
-			// Request all RGTA-unsupported resources with the same tags
-			allARNs = getARNsForUnsupportedResource(rtk, t.TagFilters, allARNs)
+			pLabel, rLabel := profileLabel(profile), regionLabel(region)
+			logPath, rerr := deleteFromTags(sess, bytes.NewReader(data), pLabel, rLabel)
+			runLogs = append(runLogs, runLog{profile: pLabel, region: rLabel, path: logPath})
+			if rerr != nil {
+				runErrs = append(runErrs, fmt.Sprintf("[profile=%s region=%s] %s", pLabel, rLabel, rerr.Error()))
+			}
 		}
 	}
 
-	// Delete batch of matching resources
-	if err := deleteARNs(allARNs); err != nil {
-		return err
+	if wantReport {
+		printAggregatedLogReport(runLogs)
 	}
 
-	if !silent {
-		arnsJSON, _ := json.MarshalIndent(allARNs, "", " ")
-		fmt.Printf("{\"DeletedARNs\": %s}\n", arnsJSON)
+	if len(runErrs) > 0 {
+		for _, e := range runErrs {
+			fmt.Printf("{\"error\": \"%s\"}\n", e)
+		}
+		return fmt.Errorf("%d of %d (profile, region) runs failed", len(runErrs), len(profiles)*len(regions))
 	}
 
 	return nil
 }
 
-func getARNsForResource(svc rgtaiface.ResourceGroupsTaggingAPIAPI, tags []*rgta.TagFilter, arnList arn.ResourceARNs) arn.ResourceARNs {
-	// Get ARNs of matching tags
-	params := &rgta.GetResourcesInput{
-		TagFilters:  tags,
-		TagsPerPage: aws.Int64(100),
-	}
+// runLog pairs a (profile, region) run with the log file deleteFromTags
+// wrote for it, so printAggregatedLogReport can tag each entry with the
+// run it came from.
+type runLog struct {
+	profile, region, path string
+}
 
-	// If available, get all resourceTypes from config file
-	rts := viper.GetStringSlice("resourceTypes")
-	if len(rts) != 0 {
-		frts := make([]*string, 0, len(rts))
-		for _, t := range rts {
-			rt := arn.ResourceType(t)
-			if _, ok := arn.RGTAUnsupportedResourceTypes[rt]; ok {
-				continue
-			}
-			frts = append(frts, aws.String(arn.NamespaceForResource(rt)))
-		}
-		params.ResourceTypeFilters = frts
+// effectiveRegions returns the regions to fan out across: --regions/config
+// "regions" if set, falling back to the single legacy "region" config value.
+func effectiveRegions() []string {
+	if len(regionsFlag) > 0 {
+		return regionsFlag
 	}
-
-	for {
-		// Request a batch of matching resources
-		ctx := aws.BackgroundContext()
-		resp, err := svc.GetResourcesWithContext(ctx, params)
-		if err != nil {
-			return arnList
-		}
-
-		if len(resp.ResourceTagMappingList) == 0 {
-			fmt.Println(`{"error": "No resources match the specified tag filters"}`)
-			return arnList
-		}
-
-		for _, r := range resp.ResourceTagMappingList {
-			if r.ResourceARN != nil && *r.ResourceARN != "" {
-				arnList = append(arnList, arn.ResourceARN(*r.ResourceARN))
-			}
-		}
-
-		if resp.PaginationToken == nil || *resp.PaginationToken == "" {
-			break
-		}
-
-		params.PaginationToken = resp.PaginationToken
+	if rs := viper.GetStringSlice("regions"); len(rs) > 0 {
+		return rs
 	}
+	return []string{viper.GetString("region")}
+}
 
-	return arnList
+// effectiveProfiles returns the AWS credential profiles to fan out across:
+// --profiles/config "profiles" if set, falling back to the default profile.
+func effectiveProfiles() []string {
+	if len(profilesFlag) > 0 {
+		return profilesFlag
+	}
+	if ps := viper.GetStringSlice("profiles"); len(ps) > 0 {
+		return ps
+	}
+	return []string{""}
 }
 
-func getARNsForUnsupportedResource(rt arn.ResourceType, tags []*rgta.TagFilter, arnList arn.ResourceARNs) arn.ResourceARNs {
-	sess := session.Must(session.NewSession(
-		&aws.Config{
-			Region: aws.String(viper.GetString("region")),
-		},
-	))
-
-	switch arn.NamespaceForResource(rt) {
-	case arn.AutoScalingNamespace:
-		getAutoScalingResourcesByTags(autoscaling.New(sess), rt, tags, &arnList)
-	case arn.Route53Namespace:
-		getRoute53ResourcesByTags(route53.New(sess), rt, tags, &arnList)
+// effectiveParallel returns the number of resources to delete concurrently
+// within a deletion stage, reading the "parallel" config value (which
+// viper.BindPFlag in init keeps in sync with --parallel) rather than the
+// flag var directly, so a config-file-only value is honored the same way
+// effectiveRegions/effectiveProfiles honor "regions"/"profiles".
+func effectiveParallel() int {
+	if p := viper.GetInt("parallel"); p > 0 {
+		return p
 	}
+	return 1
+}
 
-	return arnList
+// effectiveRateLimit returns the configured AWS API QPS cap, reading the
+// "rateLimit" config value the same way effectiveParallel reads "parallel".
+func effectiveRateLimit() float64 {
+	return viper.GetFloat64("rateLimit")
 }
 
-func getAutoScalingResourcesByTags(svc autoscalingiface.AutoScalingAPI, rt arn.ResourceType, rgtaTags []*rgta.TagFilter, arnList *arn.ResourceARNs) {
-	if len(rgtaTags) == 0 || arnList == nil {
-		return
+func profileLabel(profile string) string {
+	if profile == "" {
+		return "default"
 	}
+	return profile
+}
 
-	// Currently only AutoScaling Groups support tagging
-	if rt != arn.AutoScalingGroupRType {
-		return
+func regionLabel(region string) string {
+	if region == "" {
+		return "default"
 	}
+	return region
+}
 
-	asgTags := make([]*autoscaling.Filter, 0)
-	for _, tag := range rgtaTags {
-		asgTags = append(asgTags, &autoscaling.Filter{
-			Name:   aws.String("key"),
-			Values: aws.StringSlice([]string{*tag.Key}),
-		})
-		if len(tag.Values) > 0 {
-			asgTags = append(asgTags, &autoscaling.Filter{
-				Name:   aws.String("value"),
-				Values: tag.Values,
-			})
-		}
-	}
+// deleteFromTags decodes every TagFileInput entry in reader and runs one
+// gc.Reconciler.ReconcileDelete pass per entry using clients built from
+// sess, printing a DeletionPlan and result summary for each. All entries
+// share a single dated log file for this (profile, region) run, whose path
+// is returned so the caller can fold it into one aggregated --report across
+// every (profile, region) run once the whole fan-out completes.
+func deleteFromTags(sess *session.Session, reader io.Reader, profile, region string) (string, error) {
+	dec := json.NewDecoder(reader)
 
-	params := &autoscaling.DescribeTagsInput{
-		Filters:    asgTags,
-		MaxRecords: aws.Int64(100),
+	workers := effectiveParallel()
+	var limiter *rate.Limiter
+	if rl := effectiveRateLimit(); rl > 0 {
+		limiter = rate.NewLimiter(rate.Limit(rl), workers)
 	}
 
-	asgNames := make(arn.ResourceNames, 0)
-	for {
-		ctx := aws.BackgroundContext()
-		resp, rerr := svc.DescribeTagsWithContext(ctx, params)
-		if rerr != nil {
-			return
-		}
-
-		if len(resp.Tags) == 0 {
-			return
-		}
+	logPath := fmt.Sprintf("./delete-log-data-%s-%s-%s.log", time.Now().Format("2006-01-02"), profile, region)
 
-		for _, t := range resp.Tags {
-			asgNames = append(asgNames, arn.ResourceName(*t.ResourceId))
+	for {
+		t, isEOF, err := decodeTagFileInput(dec)
+		if err != nil {
+			return logPath, err
 		}
-
-		if resp.NextToken == nil || *resp.NextToken == "" {
+		if isEOF {
 			break
 		}
-
-		params.NextToken = resp.NextToken
-	}
-
-	asgDel := deleter.AutoScalingGroupDeleter{
-		Client:        svc,
-		ResourceNames: asgNames,
-	}
-	asgs, aerr := asgDel.RequestAutoScalingGroups()
-	if aerr != nil {
-		return
-	}
-
-	for _, asg := range asgs {
-		*arnList = append(*arnList, arn.ResourceARN(*asg.AutoScalingGroupARN))
-	}
-
-	return
-}
-
-func getRoute53ResourcesByTags(svc route53iface.Route53API, rt arn.ResourceType, rgtaTags []*rgta.TagFilter, arnList *arn.ResourceARNs) {
-	if len(rgtaTags) == 0 || arnList == nil {
-		return
-	}
-
-	// Currently only Route53 HostedZones support tagging
-	if rt != arn.Route53HostedZoneRType {
-		return
-	}
-
-	tagKeyMap := make(map[string][]string)
-	for _, tag := range rgtaTags {
-		if _, ok := tagKeyMap[*tag.Key]; !ok {
-			tagKeyMap[*tag.Key] = make([]string, 0, len(tag.Values))
-			for _, v := range tag.Values {
-				tagKeyMap[*tag.Key] = append(tagKeyMap[*tag.Key], *v)
-			}
+		if t == nil {
+			continue
 		}
-	}
-
-	rd := deleter.Route53HostedZoneDeleter{Client: svc}
-	hzs, rerr := rd.RequestAllRoute53HostedZones()
-	if rerr != nil || len(hzs) == 0 {
-		return
-	}
-
-	hzIDs := make(arn.ResourceNames, 0, len(hzs))
-	for _, hz := range hzs {
-		hzIDs = append(hzIDs, deleter.SplitHostedZoneID(*hz.Id))
-	}
 
-	size, chunk := len(hzIDs), 10
-	var (
-		params        *route53.ListTagsForResourcesInput
-		filteredHZIDs arn.ResourceNames
-	)
-	// Can only tag hosted zones in batches of 10
-	for i := 0; i < size; i += chunk {
-		stop := deleter.CalcChunk(i, size, chunk)
-		params = &route53.ListTagsForResourcesInput{
-			ResourceType: aws.String("hostedzone"),
-			ResourceIds:  hzIDs[i:stop].AWSStringSlice(),
+		r := &gc.Reconciler{
+			Session:       sess,
+			RGTA:          rgta.New(sess),
+			ASG:           autoscaling.New(sess),
+			Route53:       route53.New(sess),
+			MatchMode:     matchModeFor(t),
+			AllDeps:       delAllDeps,
+			Parallel:      workers,
+			RateLimiter:   limiter,
+			IgnoreErrors:  ignoreErrors,
+			DryRun:        dryRun,
+			LogPath:       logPath,
+			PurgeVersions: purgeVersions,
+			Logger:        slog.Default(),
 		}
 
-		ctx := aws.BackgroundContext()
-		resp, rerr := svc.ListTagsForResourcesWithContext(ctx, params)
-		if rerr != nil {
-			fmt.Printf("{\"error\": \"%s\"}\n", rerr.Error())
-			return
+		plan, err := r.Plan(aws.BackgroundContext(), t.TagFilters)
+		if err != nil {
+			return logPath, err
 		}
-
-		filteredHZIDs = filterHostedZones(resp.ResourceTagSets, tagKeyMap)
-	}
-
-	for _, id := range filteredHZIDs {
-		hzARN := fmt.Sprintf("arn:aws:route53:::hostedzone/%s", id)
-		*arnList = append(*arnList, arn.ResourceARN(hzARN))
-	}
-
-	return
-}
-
-func filterHostedZones(tagSets []*route53.ResourceTagSet, tagKeyMap map[string][]string) arn.ResourceNames {
-	filteredHZIDs := make(arn.ResourceNames, 0, len(tagSets))
-	for _, rts := range tagSets {
-		for _, tag := range rts.Tags {
-			if vals, ok := tagKeyMap[*tag.Key]; ok {
-				// If no tag values are specified, then we want all hosted zones that
-				// match a specific key but have any value. Append all that have key
-				if vals == nil || len(vals) == 0 {
-					filteredHZIDs = append(filteredHZIDs, arn.ResourceName(*rts.ResourceId))
-					continue
-				}
-				for _, v := range vals {
-					if v == *tag.Value {
-						filteredHZIDs = append(filteredHZIDs, arn.ResourceName(*rts.ResourceId))
-						break
-					}
-				}
-			}
+		if err := printPlan(plan, outputFormat); err != nil {
+			return logPath, err
 		}
-	}
-
-	return filteredHZIDs
-}
-
-// Traverse dependency graph and request all possible ID's of resource
-// dependencies, then bucket them according to ResourceType.
-func bucketARNs(ARNs arn.ResourceARNs) map[arn.ResourceType]deleter.ResourceDeleter {
-	// All ARN's stored here. Key is some arn.*RType, value is a slice of ARN's
-	resMap := make(map[arn.ResourceType]deleter.ResourceDeleter)
-	seen := map[arn.ResourceName]struct{}{}
-
-	// Initialize with all ID's from ARN's tagged in CloudTrail logs
-	for _, a := range ARNs {
-		rt, rn := arn.MapARNToRTypeAndRName(a)
-		// Remove duplicates and nil resources
-		if _, ok := seen[rn]; ok || rt == "" || rn == "" {
+		if dryRun {
 			continue
 		}
-		seen[rn] = struct{}{}
 
-		if _, ok := resMap[rt]; !ok {
-			resMap[rt] = deleter.InitResourceDeleter(rt)
+		results, err := r.Delete(aws.BackgroundContext(), plan)
+		if perr := printResults(results, outputFormat); perr != nil {
+			fmt.Printf("{\"error\": \"%s\"}\n", perr.Error())
+		}
+		if err != nil && !ignoreErrors {
+			return logPath, err
 		}
-		resMap[rt].AddResourceNames(rn)
-	}
 
-	// Unless the user specifies the --all-deps flag, do not find/delete
-	// dependencies of resources
-	if delAllDeps {
-		resMap = graph.FillDependencyGraph(resMap)
+		if !silent {
+			printPlannedARNs(plan)
+		}
 	}
 
-	return resMap
-}
-
-type delResMap struct {
-	Type     string
-	Deleters deleter.ResourceDeleter
+	return logPath, nil
 }
 
-func deleteARNs(ARNs arn.ResourceARNs) error {
-	// Create a slice of ARN's for every ResourceType in ARNs
-	resMap := bucketARNs(ARNs)
-	if len(resMap) == 0 {
-		return nil
-	}
-
-	// Ensure deletion order. Most resources have dependencies, so a dependency
-	// graph must be constructed and executed. See README for deletion order.
-	sorted := organizeByDelOrder(resMap)
-
-	// Create log filename
-	t := time.Now()
-	logFilePath := fmt.Sprintf("./delete-log-data-%d-%d-%d.log", t.Year(), t.Month(), t.Day())
-
-	cfg := &deleter.DeleteConfig{
-		IgnoreErrors: ignoreErrors,
-		DryRun:       dryRun,
-		Logger:       deleter.InitRequestLogger(logFilePath),
-	}
-
-	// Delete all ARN's in a slice mapped by ResourceType. Iterate in reverse to
-	// delete all non-dependent resources first
-	for i := len(sorted) - 1; i >= 0; i-- {
-		if err := sorted[i].Deleters.DeleteResources(cfg); err != nil {
-			fmt.Printf("{\"error\": \"%s\"}\n", err.Error())
+func printPlannedARNs(plan *gc.DeletionPlan) {
+	names := make([]string, 0)
+	for _, stage := range plan.Stages {
+		for _, r := range stage.Resources {
+			names = append(names, string(r.Name))
 		}
 	}
+	arnsJSON, _ := json.MarshalIndent(names, "", " ")
+	fmt.Printf("{\"DeletedARNs\": %s}\n", arnsJSON)
+}
 
-	// Print all failed deletion logs in report format at end of deletion cycle
-	if wantReport {
-		f, ferr := os.Open(logFilePath)
+// printAggregatedLogReport prints a single --report spanning every
+// (profile, region) run's log file, prefixing each entry with the run it
+// came from so failures across a multi-region/profile fan-out aren't
+// scattered across separate, unlabeled per-run reports.
+func printAggregatedLogReport(logs []runLog) {
+	fmt.Println(logHead)
+	for _, l := range logs {
+		f, ferr := os.Open(l.path)
 		if ferr != nil {
 			fmt.Printf("{\"error\": \"%s\"}\n", ferr.Error())
-			return nil
-		}
-		defer f.Close()
-		fmt.Println(logHead)
-		deleter.PrintLogFileReport(bufio.NewReader(f), formatReportLogEntry)
-		fmt.Println(logTail)
-	}
-
-	return nil
-}
-
-func organizeByDelOrder(resMap map[arn.ResourceType]deleter.ResourceDeleter) []delResMap {
-	sorted := make([]delResMap, 0, len(resMap))
-
-	// Append ARN's to sorted in deletion order
-	for _, rt := range DeleteOrder {
-		if dels, ok := resMap[rt]; ok {
-			sorted = append(sorted, delResMap{
-				Type:     rt.String(),
-				Deleters: dels,
-			})
-			delete(resMap, rt)
+			continue
 		}
-	}
-
-	// Add the remaining ARN's
-	for rt, dels := range resMap {
-		sorted = append(sorted, delResMap{
-			Type:     rt.String(),
-			Deleters: dels,
+		prefix := fmt.Sprintf("[profile=%s region=%s] ", l.profile, l.region)
+		deleter.PrintLogFileReport(bufio.NewReader(f), func(e *deleter.LogEntry) string {
+			return prefix + formatReportLogEntry(e)
 		})
+		f.Close()
 	}
-
-	return sorted
+	fmt.Println(logTail)
 }
 
 func decodeTagFileInput(decoder *json.Decoder) (*TagFileInput, bool, error) {
@@ -523,3 +363,60 @@ func formatReportLogEntry(e *deleter.LogEntry) (m string) {
 
 	return
 }
+
+func printPlan(plan *gc.DeletionPlan, format string) error {
+	switch format {
+	case OutputYAML:
+		out, err := yaml.Marshal(plan)
+		if err != nil {
+			return err
+		}
+		fmt.Print(string(out))
+	case OutputTable:
+		fmt.Print(planTable(plan))
+	default:
+		out, err := json.MarshalIndent(plan, "", " ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(out))
+	}
+	return nil
+}
+
+func planTable(plan *gc.DeletionPlan) string {
+	var b strings.Builder
+	for _, stage := range plan.Stages {
+		fmt.Fprintf(&b, "== %s (%d) ==\n", stage.Type, len(stage.Resources))
+		for _, r := range stage.Resources {
+			if r.AddedByDeps {
+				fmt.Fprintf(&b, "  %s (added by --all-deps)\n", r.Name)
+				continue
+			}
+			fmt.Fprintf(&b, "  %s\n", r.Name)
+		}
+	}
+	return b.String()
+}
+
+func printResults(results []gc.StageResult, format string) error {
+	switch format {
+	case OutputYAML:
+		out, err := yaml.Marshal(results)
+		if err != nil {
+			return err
+		}
+		fmt.Print(string(out))
+	case OutputTable:
+		var b strings.Builder
+		for _, r := range results {
+			fmt.Fprintf(&b, "== %s == deleted: %d, failed: %d\n", r.Type, r.Ok, r.Failed)
+		}
+		fmt.Print(b.String())
+	default:
+		for _, r := range results {
+			fmt.Printf("{\"type\": \"%s\", \"deleted\": %d, \"failed\": %d}\n", r.Type, r.Ok, r.Failed)
+		}
+	}
+	return nil
+}
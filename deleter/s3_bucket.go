@@ -0,0 +1,206 @@
+// Copyright © 2017 grafiti authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deleter
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/coreos/grafiti/arn"
+)
+
+// s3ObjectBatchSize is the maximum number of keys S3's DeleteObjects API
+// accepts in a single request.
+const s3ObjectBatchSize = 1000
+
+// S3BucketDeleter deletes S3 buckets. When DeleteConfig.PurgeVersions is
+// set, it first purges every object version (current and non-current) and
+// delete marker, which AWS requires before DeleteBucket will succeed on a versioned
+// bucket; unversioned buckets are left untouched by the purge step.
+type S3BucketDeleter struct {
+	Client      s3iface.S3API
+	BucketNames arn.ResourceNames
+}
+
+// AddResourceNames appends bucket names to delete.
+func (d *S3BucketDeleter) AddResourceNames(ns ...arn.ResourceName) {
+	d.BucketNames = append(d.BucketNames, ns...)
+}
+
+// ResourceNames returns the bucket names queued for deletion.
+func (d *S3BucketDeleter) ResourceNames() arn.ResourceNames {
+	return d.BucketNames
+}
+
+// DeleteResources deletes every bucket in d.BucketNames, purging object
+// versions and delete markers first when cfg.PurgeVersions is set.
+func (d *S3BucketDeleter) DeleteResources(cfg *DeleteConfig) error {
+	if cfg.DryRun {
+		return nil
+	}
+
+	var firstErr error
+	for _, name := range d.BucketNames {
+		bucket := string(name)
+
+		if cfg.PurgeVersions {
+			if err := d.purgeBucketVersions(cfg, bucket); err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				if !cfg.IgnoreErrors {
+					return firstErr
+				}
+			}
+		}
+
+		if _, err := d.Client.DeleteBucket(&s3.DeleteBucketInput{Bucket: aws.String(bucket)}); err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			if !cfg.IgnoreErrors {
+				return firstErr
+			}
+		}
+	}
+
+	return firstErr
+}
+
+// purgeBucketVersions lists every object version and delete marker in
+// bucket and removes them via batched, quiet DeleteObjects calls chunked to
+// S3's 1000-key-per-request limit, running up to cfg.Parallel batches
+// concurrently. Per-object failures are recorded to cfg.Logger instead of
+// aborting the whole purge.
+func (d *S3BucketDeleter) purgeBucketVersions(cfg *DeleteConfig, bucket string) error {
+	vresp, err := d.Client.GetBucketVersioning(&s3.GetBucketVersioningInput{Bucket: aws.String(bucket)})
+	if err != nil {
+		return fmt.Errorf("failed to get versioning state for bucket %s: %w", bucket, err)
+	}
+	// A bucket that was never versioned has no versions or delete markers
+	// to purge.
+	if vresp.Status == nil {
+		return nil
+	}
+
+	var ids []*s3.ObjectIdentifier
+	lerr := d.Client.ListObjectVersionsPages(
+		&s3.ListObjectVersionsInput{Bucket: aws.String(bucket)},
+		func(page *s3.ListObjectVersionsOutput, lastPage bool) bool {
+			for _, v := range page.Versions {
+				ids = append(ids, &s3.ObjectIdentifier{Key: v.Key, VersionId: v.VersionId})
+			}
+			for _, m := range page.DeleteMarkers {
+				ids = append(ids, &s3.ObjectIdentifier{Key: m.Key, VersionId: m.VersionId})
+			}
+			return true
+		},
+	)
+	if lerr != nil {
+		return fmt.Errorf("failed to list object versions for bucket %s: %w", bucket, lerr)
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	workers := cfg.Parallel
+	if workers < 1 {
+		workers = 1
+	}
+
+	tasks := make(chan struct{}, workers)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var firstErr error
+
+	for i := 0; i < len(ids); i += s3ObjectBatchSize {
+		stop := CalcChunk(i, len(ids), s3ObjectBatchSize)
+		batch := ids[i:stop]
+
+		wg.Add(1)
+		tasks <- struct{}{}
+		go func(batch []*s3.ObjectIdentifier) {
+			defer wg.Done()
+			defer func() { <-tasks }()
+
+			if err := d.deleteObjectBatch(cfg, bucket, batch); err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				mu.Unlock()
+			}
+		}(batch)
+	}
+	wg.Wait()
+
+	return firstErr
+}
+
+// deleteObjectBatch issues a single quiet DeleteObjects call for up to 1000
+// object versions/delete markers. Each per-object failure AWS reports back
+// is logged as an ObjectLogEntry event, and the batch then returns an error
+// counting those failures.
+func (d *S3BucketDeleter) deleteObjectBatch(cfg *DeleteConfig, bucket string, batch []*s3.ObjectIdentifier) error {
+	resp, err := d.Client.DeleteObjects(&s3.DeleteObjectsInput{
+		Bucket: aws.String(bucket),
+		Delete: &s3.Delete{
+			Objects: batch,
+			Quiet:   aws.Bool(true),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete object versions from bucket %s: %w", bucket, err)
+	}
+
+	for _, oerr := range resp.Errors {
+		cfg.logObjectError(bucket, oerr)
+	}
+	if len(resp.Errors) > 0 {
+		return fmt.Errorf("failed to delete %d object version(s) from bucket %s", len(resp.Errors), bucket)
+	}
+
+	return nil
+}
+
+// logObjectError records a single object version/delete marker deletion
+// failure to cfg.Logger, if set.
+func (cfg *DeleteConfig) logObjectError(bucket string, oerr *s3.Error) {
+	if cfg.Logger == nil || oerr == nil {
+		return
+	}
+	cfg.Logger.Log(&ObjectLogEntry{
+		LogEntry: LogEntry{
+			ResourceType:       arn.ResourceType("s3:object"),
+			ResourceName:       arn.ResourceName(aws.StringValue(oerr.Key)),
+			ParentResourceType: arn.S3BucketRType,
+			ParentResourceName: arn.ResourceName(bucket),
+			AWSErrorCode:       aws.StringValue(oerr.Code),
+			AWSErrorMsg:        aws.StringValue(oerr.Message),
+		},
+		VersionID: aws.StringValue(oerr.VersionId),
+	})
+}
+
+// ObjectLogEntry is a LogEntry variant for failures scoped to a single
+// object version or delete marker within a bucket purge, as opposed to the
+// bucket resource itself.
+type ObjectLogEntry struct {
+	LogEntry
+	VersionID string
+}
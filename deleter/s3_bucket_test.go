@@ -0,0 +1,117 @@
+// Copyright © 2017 grafiti authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deleter
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// fakeVersionedS3 is an s3iface.S3API double with a fixed number of object
+// versions in one bucket. DeleteObjects records every batch size it was
+// called with and the peak number of concurrent calls it observed, so tests
+// can assert on purgeBucketVersions' chunking and concurrency behavior.
+type fakeVersionedS3 struct {
+	s3iface.S3API
+
+	objectCount int
+
+	mu            sync.Mutex
+	batchSizes    []int
+	current       int32
+	maxConcurrent int32
+}
+
+func (f *fakeVersionedS3) GetBucketVersioning(*s3.GetBucketVersioningInput) (*s3.GetBucketVersioningOutput, error) {
+	return &s3.GetBucketVersioningOutput{Status: aws.String(s3.BucketVersioningStatusEnabled)}, nil
+}
+
+func (f *fakeVersionedS3) ListObjectVersionsPages(_ *s3.ListObjectVersionsInput, fn func(*s3.ListObjectVersionsOutput, bool) bool) error {
+	versions := make([]*s3.ObjectVersion, f.objectCount)
+	for i := range versions {
+		versions[i] = &s3.ObjectVersion{Key: aws.String(fmt.Sprintf("obj-%d", i)), VersionId: aws.String("v1")}
+	}
+	fn(&s3.ListObjectVersionsOutput{Versions: versions}, true)
+	return nil
+}
+
+func (f *fakeVersionedS3) DeleteObjects(in *s3.DeleteObjectsInput) (*s3.DeleteObjectsOutput, error) {
+	cur := atomic.AddInt32(&f.current, 1)
+	for {
+		max := atomic.LoadInt32(&f.maxConcurrent)
+		if cur <= max {
+			break
+		}
+		if atomic.CompareAndSwapInt32(&f.maxConcurrent, max, cur) {
+			break
+		}
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	atomic.AddInt32(&f.current, -1)
+
+	f.mu.Lock()
+	f.batchSizes = append(f.batchSizes, len(in.Delete.Objects))
+	f.mu.Unlock()
+
+	return &s3.DeleteObjectsOutput{}, nil
+}
+
+// TestPurgeBucketVersionsChunksTo1000 guards against purgeBucketVersions
+// regressing away from S3's 1000-key-per-DeleteObjects-request limit, and
+// against running all batches sequentially regardless of cfg.Parallel.
+func TestPurgeBucketVersionsChunksTo1000(t *testing.T) {
+	const (
+		objectCount = 2500
+		parallel    = 3
+	)
+
+	fake := &fakeVersionedS3{objectCount: objectCount}
+	d := &S3BucketDeleter{Client: fake}
+
+	if err := d.purgeBucketVersions(&DeleteConfig{Parallel: parallel}, "my-bucket"); err != nil {
+		t.Fatalf("purgeBucketVersions() error = %v", err)
+	}
+
+	fake.mu.Lock()
+	gotSizes := append([]int(nil), fake.batchSizes...)
+	fake.mu.Unlock()
+
+	sort.Sort(sort.Reverse(sort.IntSlice(gotSizes)))
+	wantSizes := []int{1000, 1000, 500}
+	if len(gotSizes) != len(wantSizes) {
+		t.Fatalf("DeleteObjects called with batch sizes %v, want %v", gotSizes, wantSizes)
+	}
+	for i := range wantSizes {
+		if gotSizes[i] != wantSizes[i] {
+			t.Fatalf("DeleteObjects called with batch sizes %v, want %v", gotSizes, wantSizes)
+		}
+	}
+
+	if got := atomic.LoadInt32(&fake.maxConcurrent); got > parallel {
+		t.Fatalf("observed %d concurrent DeleteObjects calls, want at most cfg.Parallel=%d", got, parallel)
+	}
+	if got := atomic.LoadInt32(&fake.maxConcurrent); got < 2 {
+		t.Fatalf("observed only %d concurrent DeleteObjects calls, want batches to run in parallel up to cfg.Parallel=%d", got, parallel)
+	}
+}
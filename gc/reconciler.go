@@ -0,0 +1,660 @@
+// Copyright © 2017 grafiti authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package gc exposes grafiti's tag-based deletion pipeline as an importable
+// library. Unlike the grafiti CLI, a Reconciler never constructs AWS
+// sessions or clients itself; callers inject them, which makes it possible
+// to embed garbage collection of orphaned, tagged resources inside a
+// longer-running process (for example a Kubernetes controller that
+// periodically GCs resources left behind by torn-down clusters), the way
+// the Cluster API AWS provider's GC service does.
+package gc
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/autoscaling/autoscalingiface"
+	rgta "github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi"
+	rgtaiface "github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi/resourcegroupstaggingapiiface"
+	"github.com/aws/aws-sdk-go/service/route53"
+	"github.com/aws/aws-sdk-go/service/route53/route53iface"
+	"github.com/coreos/grafiti/arn"
+	"github.com/coreos/grafiti/deleter"
+	"github.com/coreos/grafiti/graph"
+	"golang.org/x/time/rate"
+)
+
+// MatchMode controls how the TagFilters passed to a Reconciler call are
+// combined when looking up matching resources.
+type MatchMode string
+
+const (
+	// MatchModeAnd requires a resource to match every TagFilter. This
+	// mirrors the semantics AWS' GetResources API applies across distinct
+	// tag keys, and is the default when MatchMode is left empty.
+	MatchModeAnd MatchMode = "and"
+	// MatchModeOr requires a resource to match any one TagFilter. RGTA has
+	// no native way to express this across distinct keys, so the Reconciler
+	// emulates it by issuing one query per filter and unioning the results.
+	MatchModeOr MatchMode = "or"
+)
+
+// DeleteOrder contains the REVERSE order of deletion for all resource types.
+var DeleteOrder = arn.ResourceTypes{
+	arn.EC2VPCRType,
+	arn.EC2VPNGatewayRType, // Deletes EC2 VPN Gateway Attachments
+	arn.EC2SecurityGroupRType,
+	arn.EC2RouteTableRType, // Deletes EC2 Route Table Routes
+	arn.EC2SubnetRType,
+	arn.EC2VolumeRType,
+	arn.EC2CustomerGatewayRType,
+	arn.EC2VPNConnectionRType, // Deletes EC2 VPN Connection Routes
+	arn.EC2NetworkACLRType,
+	arn.EC2NetworkInterfaceRType,
+	arn.EC2InternetGatewayRType,
+	arn.IAMUserRType,
+	arn.IAMRoleRType, // Deletes IAM Role Policies
+	arn.IAMInstanceProfileRType,
+	arn.AutoScalingLaunchConfigurationRType,
+	arn.EC2EIPRType,
+	arn.EC2EIPAssociationRType,
+	arn.EC2NatGatewayRType,
+	arn.ElasticLoadBalancingLoadBalancerRType,
+	arn.AutoScalingGroupRType,
+	arn.EC2InstanceRType,
+	arn.EC2RouteTableAssociationRType,
+	arn.Route53HostedZoneRType, // Deletes Route53 RecordSets
+	arn.S3BucketRType,          // Delete S3 Objects
+}
+
+// Reconciler deletes AWS resources matching a set of tag filters. Callers
+// supply already-constructed AWS clients; the Reconciler never builds a
+// session on its own.
+type Reconciler struct {
+	RGTA    rgtaiface.ResourceGroupsTaggingAPIAPI
+	ASG     autoscalingiface.AutoScalingAPI
+	Route53 route53iface.Route53API
+
+	// Session is the AWS session the per-type deleters built by NewDeleter
+	// (or the default deleter.InitResourceDeleter) should use to construct
+	// their own service clients, so deletion targets the same region and
+	// credential profile that RGTA/ASG/Route53 were scanned with.
+	Session *session.Session
+
+	// NewDeleter constructs the ResourceDeleter used to delete resources of
+	// a given type. Defaults to deleter.InitResourceDeleter.
+	NewDeleter func(arn.ResourceType) deleter.ResourceDeleter
+
+	// MatchMode selects how TagFilters passed to ReconcileDelete/Plan are
+	// combined. Defaults to MatchModeAnd.
+	MatchMode MatchMode
+	// AllDeps causes dependencies of matched resources to be pulled in via
+	// graph.FillDependencyGraph before deletion.
+	AllDeps bool
+	// Parallel bounds how many resources within a single deletion stage are
+	// deleted concurrently. Defaults to 1.
+	Parallel int
+	// RateLimiter, when set, is shared across all deletion workers and is
+	// waited on once before each resource deletion starts. It does not limit
+	// the individual AWS API calls a deletion makes.
+	RateLimiter *rate.Limiter
+	// IgnoreErrors and DryRun are forwarded to deleter.DeleteConfig.
+	IgnoreErrors bool
+	DryRun       bool
+	// LogPath is forwarded to deleter.InitRequestLogger to record failed
+	// deletion events for later inspection.
+	LogPath string
+	// PurgeVersions causes the S3 bucket deleter to purge all object
+	// versions, current and non-current, and delete markers (via ListObjectVersions/batched
+	// DeleteObjects) before attempting DeleteBucket, which AWS requires for
+	// versioned buckets. Unversioned buckets are unaffected.
+	PurgeVersions bool
+
+	// Logger receives structured diagnostics in place of the CLI's
+	// fmt.Printf calls. Defaults to slog.Default().
+	Logger *slog.Logger
+}
+
+// PlanResource describes a single resource within a DeletionPlan stage.
+type PlanResource struct {
+	Name arn.ResourceName
+	// AddedByDeps is true when this resource was not directly tagged but
+	// was pulled in because Reconciler.AllDeps was set.
+	AddedByDeps bool
+}
+
+// PlanStage describes the resources that would be deleted at one step of
+// the deletion order.
+type PlanStage struct {
+	Type      arn.ResourceType
+	Resources []PlanResource
+
+	deleters deleter.ResourceDeleter
+}
+
+// DeletionPlan is the structured description of what Delete would do, in
+// actual deletion order.
+type DeletionPlan struct {
+	Stages []PlanStage
+}
+
+// StageResult reports the outcome of deleting a single DeletionPlan stage.
+type StageResult struct {
+	Type   arn.ResourceType
+	Ok     int
+	Failed int
+}
+
+func (r *Reconciler) logger() *slog.Logger {
+	if r.Logger != nil {
+		return r.Logger
+	}
+	return slog.Default()
+}
+
+// ReconcileDelete resolves filters to AWS resources, determines a safe
+// deletion order and deletes them, deleting as much as IgnoreErrors allows
+// on failure. It is a convenience wrapper around Plan followed by Delete.
+func (r *Reconciler) ReconcileDelete(ctx context.Context, filters []*rgta.TagFilter) error {
+	plan, err := r.Plan(ctx, filters)
+	if err != nil {
+		return err
+	}
+	if r.DryRun {
+		return nil
+	}
+	_, err = r.Delete(ctx, plan)
+	return err
+}
+
+// Plan resolves filters to AWS resources and organizes them into a
+// DeletionPlan without deleting anything.
+func (r *Reconciler) Plan(ctx context.Context, filters []*rgta.TagFilter) (*DeletionPlan, error) {
+	arns := r.resolveARNs(ctx, filters)
+	resMap, tagged := r.bucketARNs(arns)
+	return buildDeletionPlan(r.organizeByDelOrder(resMap, tagged)), nil
+}
+
+// Delete deletes every stage of plan in order, waiting for each stage to
+// drain before starting the next, since later stages may depend on earlier
+// ones having already been removed.
+func (r *Reconciler) Delete(ctx context.Context, plan *DeletionPlan) ([]StageResult, error) {
+	workers := r.Parallel
+	if workers < 1 {
+		workers = 1
+	}
+
+	cfg := &deleter.DeleteConfig{
+		Session:       r.Session,
+		IgnoreErrors:  r.IgnoreErrors,
+		DryRun:        r.DryRun,
+		Logger:        deleter.InitRequestLogger(r.LogPath),
+		Parallel:      workers,
+		RateLimiter:   r.RateLimiter,
+		PurgeVersions: r.PurgeVersions,
+	}
+
+	results := make([]StageResult, 0, len(plan.Stages))
+	var firstErr error
+	for _, stage := range plan.Stages {
+		res := r.runStage(ctx, stage, cfg, workers)
+		results = append(results, res)
+		if res.Failed > 0 && firstErr == nil {
+			firstErr = fmt.Errorf("failed to delete %d %s resources", res.Failed, res.Type)
+		}
+	}
+
+	if firstErr != nil && !r.IgnoreErrors {
+		return results, firstErr
+	}
+	return results, nil
+}
+
+// runStage dispatches one deletion task per resource name in stage into a
+// bounded channel of size workers, waiting for all of them to drain before
+// returning since the next stage may depend on this one having finished.
+// cfg.RateLimiter, when set, is consulted before every deletion so stages
+// with many resources don't start deletions faster than the configured rate.
+func (r *Reconciler) runStage(ctx context.Context, stage PlanStage, cfg *deleter.DeleteConfig, workers int) StageResult {
+	result := StageResult{Type: stage.Type}
+	names := stage.deleters.ResourceNames()
+	if len(names) == 0 {
+		return result
+	}
+
+	tasks := make(chan struct{}, workers)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+
+	for _, name := range names {
+		wg.Add(1)
+		tasks <- struct{}{}
+		go func(name arn.ResourceName) {
+			defer wg.Done()
+			defer func() { <-tasks }()
+
+			if cfg.RateLimiter != nil {
+				if werr := cfg.RateLimiter.Wait(ctx); werr != nil {
+					mu.Lock()
+					result.Failed++
+					mu.Unlock()
+					return
+				}
+			}
+
+			del := r.newDeleter(stage.Type)
+			del.AddResourceNames(name)
+			err := del.DeleteResources(cfg)
+
+			mu.Lock()
+			if err != nil {
+				r.logger().Error("failed to delete resource", "type", stage.Type, "name", name, "error", err)
+				result.Failed++
+			} else {
+				result.Ok++
+			}
+			mu.Unlock()
+		}(name)
+	}
+	wg.Wait()
+
+	return result
+}
+
+func (r *Reconciler) newDeleter(rt arn.ResourceType) deleter.ResourceDeleter {
+	if r.NewDeleter != nil {
+		return r.NewDeleter(rt)
+	}
+	return deleter.InitResourceDeleter(rt, r.Session)
+}
+
+func (r *Reconciler) matchMode() MatchMode {
+	if r.MatchMode != "" {
+		return r.MatchMode
+	}
+	return MatchModeAnd
+}
+
+// resolveARNs looks up every ARN matching filters, combining RGTA results
+// with the RGTA-unsupported resource types (AutoScaling Groups, Route53
+// Hosted Zones).
+func (r *Reconciler) resolveARNs(ctx context.Context, filters []*rgta.TagFilter) arn.ResourceARNs {
+	var allARNs arn.ResourceARNs
+
+	if r.matchMode() == MatchModeOr {
+		allARNs = r.getARNsForResourceOR(ctx, filters, allARNs)
+	} else {
+		allARNs = r.getARNsForResource(ctx, filters, allARNs)
+	}
+
+	for rtk := range arn.RGTAUnsupportedResourceTypes {
+		allARNs = r.getARNsForUnsupportedResource(rtk, filters, allARNs)
+	}
+
+	return allARNs
+}
+
+func (r *Reconciler) getARNsForResource(ctx context.Context, tags []*rgta.TagFilter, arnList arn.ResourceARNs) arn.ResourceARNs {
+	params := &rgta.GetResourcesInput{
+		TagFilters:  tags,
+		TagsPerPage: aws.Int64(100),
+	}
+
+	for {
+		resp, err := r.RGTA.GetResourcesWithContext(ctx, params)
+		if err != nil {
+			r.logger().Error("failed to get tagged resources", "error", err)
+			return arnList
+		}
+
+		if len(resp.ResourceTagMappingList) == 0 {
+			r.logger().Info("no resources match the specified tag filters")
+			return arnList
+		}
+
+		for _, rr := range resp.ResourceTagMappingList {
+			if rr.ResourceARN != nil && *rr.ResourceARN != "" {
+				arnList = append(arnList, arn.ResourceARN(*rr.ResourceARN))
+			}
+		}
+
+		if resp.PaginationToken == nil || *resp.PaginationToken == "" {
+			break
+		}
+		params.PaginationToken = resp.PaginationToken
+	}
+
+	return arnList
+}
+
+// getARNsForResourceOR unions the ARNs matching each individual TagFilter,
+// since RGTA itself cannot express OR semantics across distinct tag keys.
+func (r *Reconciler) getARNsForResourceOR(ctx context.Context, tags []*rgta.TagFilter, arnList arn.ResourceARNs) arn.ResourceARNs {
+	for _, tag := range tags {
+		arnList = r.getARNsForResource(ctx, []*rgta.TagFilter{tag}, arnList)
+	}
+	return dedupeARNs(arnList)
+}
+
+func (r *Reconciler) getARNsForUnsupportedResource(rt arn.ResourceType, tags []*rgta.TagFilter, arnList arn.ResourceARNs) arn.ResourceARNs {
+	switch arn.NamespaceForResource(rt) {
+	case arn.AutoScalingNamespace:
+		r.getAutoScalingResourcesByTags(rt, tags, &arnList)
+	case arn.Route53Namespace:
+		r.getRoute53ResourcesByTags(rt, tags, &arnList)
+	}
+	return arnList
+}
+
+func (r *Reconciler) getAutoScalingResourcesByTags(rt arn.ResourceType, rgtaTags []*rgta.TagFilter, arnList *arn.ResourceARNs) {
+	if len(rgtaTags) == 0 || arnList == nil || r.ASG == nil {
+		return
+	}
+	// Currently only AutoScaling Groups support tagging
+	if rt != arn.AutoScalingGroupRType {
+		return
+	}
+
+	if r.matchMode() == MatchModeOr {
+		for _, tag := range rgtaTags {
+			r.describeAutoScalingGroupsByTags([]*rgta.TagFilter{tag}, arnList)
+		}
+		*arnList = dedupeARNs(*arnList)
+		return
+	}
+
+	r.describeAutoScalingGroupsByTags(rgtaTags, arnList)
+}
+
+func (r *Reconciler) describeAutoScalingGroupsByTags(rgtaTags []*rgta.TagFilter, arnList *arn.ResourceARNs) {
+	asgTags := make([]*autoscaling.Filter, 0)
+	for _, tag := range rgtaTags {
+		asgTags = append(asgTags, &autoscaling.Filter{
+			Name:   aws.String("key"),
+			Values: aws.StringSlice([]string{*tag.Key}),
+		})
+		if len(tag.Values) > 0 {
+			asgTags = append(asgTags, &autoscaling.Filter{
+				Name:   aws.String("value"),
+				Values: tag.Values,
+			})
+		}
+	}
+
+	params := &autoscaling.DescribeTagsInput{
+		Filters:    asgTags,
+		MaxRecords: aws.Int64(100),
+	}
+
+	asgNames := make(arn.ResourceNames, 0)
+	for {
+		ctx := aws.BackgroundContext()
+		resp, rerr := r.ASG.DescribeTagsWithContext(ctx, params)
+		if rerr != nil {
+			return
+		}
+		if len(resp.Tags) == 0 {
+			return
+		}
+		for _, t := range resp.Tags {
+			asgNames = append(asgNames, arn.ResourceName(*t.ResourceId))
+		}
+		if resp.NextToken == nil || *resp.NextToken == "" {
+			break
+		}
+		params.NextToken = resp.NextToken
+	}
+
+	asgDel := deleter.AutoScalingGroupDeleter{
+		Client:        r.ASG,
+		ResourceNames: asgNames,
+	}
+	asgs, aerr := asgDel.RequestAutoScalingGroups()
+	if aerr != nil {
+		return
+	}
+	for _, asg := range asgs {
+		*arnList = append(*arnList, arn.ResourceARN(*asg.AutoScalingGroupARN))
+	}
+}
+
+func (r *Reconciler) getRoute53ResourcesByTags(rt arn.ResourceType, rgtaTags []*rgta.TagFilter, arnList *arn.ResourceARNs) {
+	if len(rgtaTags) == 0 || arnList == nil || r.Route53 == nil {
+		return
+	}
+	// Currently only Route53 HostedZones support tagging
+	if rt != arn.Route53HostedZoneRType {
+		return
+	}
+
+	rd := deleter.Route53HostedZoneDeleter{Client: r.Route53}
+	hzs, rerr := rd.RequestAllRoute53HostedZones()
+	if rerr != nil || len(hzs) == 0 {
+		return
+	}
+
+	hzIDs := make(arn.ResourceNames, 0, len(hzs))
+	for _, hz := range hzs {
+		hzIDs = append(hzIDs, deleter.SplitHostedZoneID(*hz.Id))
+	}
+
+	tagSets := r.listRoute53TagSets(hzIDs)
+
+	var filteredHZIDs arn.ResourceNames
+	if r.matchMode() == MatchModeOr {
+		for _, tag := range rgtaTags {
+			filteredHZIDs = append(filteredHZIDs, filterHostedZones(tagSets, tagKeyMapFor(tag))...)
+		}
+		filteredHZIDs = dedupeResourceNames(filteredHZIDs)
+	} else {
+		filteredHZIDs = filterHostedZonesAll(tagSets, tagKeyMapFor(rgtaTags...))
+	}
+
+	for _, id := range filteredHZIDs {
+		hzARN := fmt.Sprintf("arn:aws:route53:::hostedzone/%s", id)
+		*arnList = append(*arnList, arn.ResourceARN(hzARN))
+	}
+}
+
+// listRoute53TagSets fetches the tag sets for a batch of hosted zone IDs,
+// chunked to Route53's 10-resource-per-request limit.
+func (r *Reconciler) listRoute53TagSets(hzIDs arn.ResourceNames) []*route53.ResourceTagSet {
+	size, chunk := len(hzIDs), 10
+	var tagSets []*route53.ResourceTagSet
+	for i := 0; i < size; i += chunk {
+		stop := deleter.CalcChunk(i, size, chunk)
+		params := &route53.ListTagsForResourcesInput{
+			ResourceType: aws.String("hostedzone"),
+			ResourceIds:  hzIDs[i:stop].AWSStringSlice(),
+		}
+
+		ctx := aws.BackgroundContext()
+		resp, rerr := r.Route53.ListTagsForResourcesWithContext(ctx, params)
+		if rerr != nil {
+			r.logger().Error("failed to list route53 tags", "error", rerr)
+			continue
+		}
+		tagSets = append(tagSets, resp.ResourceTagSets...)
+	}
+	return tagSets
+}
+
+func tagKeyMapFor(tags ...*rgta.TagFilter) map[string][]string {
+	tagKeyMap := make(map[string][]string)
+	for _, tag := range tags {
+		if _, ok := tagKeyMap[*tag.Key]; !ok {
+			tagKeyMap[*tag.Key] = make([]string, 0, len(tag.Values))
+			for _, v := range tag.Values {
+				tagKeyMap[*tag.Key] = append(tagKeyMap[*tag.Key], *v)
+			}
+		}
+	}
+	return tagKeyMap
+}
+
+// filterHostedZones returns hosted zones matching ANY key/value pair in
+// tagKeyMap.
+func filterHostedZones(tagSets []*route53.ResourceTagSet, tagKeyMap map[string][]string) arn.ResourceNames {
+	filteredHZIDs := make(arn.ResourceNames, 0, len(tagSets))
+	for _, rts := range tagSets {
+		for _, tag := range rts.Tags {
+			vals, ok := tagKeyMap[*tag.Key]
+			if !ok {
+				continue
+			}
+			if len(vals) == 0 {
+				filteredHZIDs = append(filteredHZIDs, arn.ResourceName(*rts.ResourceId))
+				continue
+			}
+			for _, v := range vals {
+				if v == *tag.Value {
+					filteredHZIDs = append(filteredHZIDs, arn.ResourceName(*rts.ResourceId))
+					break
+				}
+			}
+		}
+	}
+	return filteredHZIDs
+}
+
+// filterHostedZonesAll returns hosted zones matching EVERY key (and, when
+// given, value) in tagKeyMap.
+func filterHostedZonesAll(tagSets []*route53.ResourceTagSet, tagKeyMap map[string][]string) arn.ResourceNames {
+	filteredHZIDs := make(arn.ResourceNames, 0, len(tagSets))
+	for _, rts := range tagSets {
+		matched := make(map[string]struct{}, len(tagKeyMap))
+		for _, tag := range rts.Tags {
+			vals, ok := tagKeyMap[*tag.Key]
+			if !ok {
+				continue
+			}
+			if len(vals) == 0 {
+				matched[*tag.Key] = struct{}{}
+				continue
+			}
+			for _, v := range vals {
+				if v == *tag.Value {
+					matched[*tag.Key] = struct{}{}
+					break
+				}
+			}
+		}
+		if len(matched) == len(tagKeyMap) {
+			filteredHZIDs = append(filteredHZIDs, arn.ResourceName(*rts.ResourceId))
+		}
+	}
+	return filteredHZIDs
+}
+
+func dedupeARNs(arnList arn.ResourceARNs) arn.ResourceARNs {
+	seen := make(map[arn.ResourceARN]struct{}, len(arnList))
+	deduped := make(arn.ResourceARNs, 0, len(arnList))
+	for _, a := range arnList {
+		if _, ok := seen[a]; ok {
+			continue
+		}
+		seen[a] = struct{}{}
+		deduped = append(deduped, a)
+	}
+	return deduped
+}
+
+func dedupeResourceNames(names arn.ResourceNames) arn.ResourceNames {
+	seen := make(map[arn.ResourceName]struct{}, len(names))
+	deduped := make(arn.ResourceNames, 0, len(names))
+	for _, n := range names {
+		if _, ok := seen[n]; ok {
+			continue
+		}
+		seen[n] = struct{}{}
+		deduped = append(deduped, n)
+	}
+	return deduped
+}
+
+// bucketARNs traverses arns and buckets them by ResourceType, pulling in
+// dependencies via graph.FillDependencyGraph when AllDeps is set.
+func (r *Reconciler) bucketARNs(arns arn.ResourceARNs) (map[arn.ResourceType]deleter.ResourceDeleter, map[arn.ResourceType]arn.ResourceNames) {
+	resMap := make(map[arn.ResourceType]deleter.ResourceDeleter)
+	tagged := make(map[arn.ResourceType]arn.ResourceNames)
+	seen := map[arn.ResourceName]struct{}{}
+
+	for _, a := range arns {
+		rt, rn := arn.MapARNToRTypeAndRName(a)
+		if _, ok := seen[rn]; ok || rt == "" || rn == "" {
+			continue
+		}
+		seen[rn] = struct{}{}
+
+		if _, ok := resMap[rt]; !ok {
+			resMap[rt] = r.newDeleter(rt)
+		}
+		resMap[rt].AddResourceNames(rn)
+		tagged[rt] = append(tagged[rt], rn)
+	}
+
+	if r.AllDeps {
+		resMap = graph.FillDependencyGraph(resMap)
+	}
+
+	return resMap, tagged
+}
+
+func (r *Reconciler) organizeByDelOrder(resMap map[arn.ResourceType]deleter.ResourceDeleter, tagged map[arn.ResourceType]arn.ResourceNames) []PlanStage {
+	sorted := make([]PlanStage, 0, len(resMap))
+
+	appendStage := func(rt arn.ResourceType, dels deleter.ResourceDeleter) {
+		taggedSet := make(map[arn.ResourceName]struct{}, len(tagged[rt]))
+		for _, n := range tagged[rt] {
+			taggedSet[n] = struct{}{}
+		}
+
+		stage := PlanStage{Type: rt, deleters: dels}
+		for _, name := range dels.ResourceNames() {
+			_, wasTagged := taggedSet[name]
+			stage.Resources = append(stage.Resources, PlanResource{
+				Name:        name,
+				AddedByDeps: r.AllDeps && !wasTagged,
+			})
+		}
+		sorted = append(sorted, stage)
+	}
+
+	// DeleteOrder is the REVERSE order of deletion, so walk it back to front
+	// to build stages in actual deletion order; Delete then runs them
+	// front-to-back, and the DeletionPlan printed by Plan reflects exactly
+	// what will happen.
+	for i := len(DeleteOrder) - 1; i >= 0; i-- {
+		rt := DeleteOrder[i]
+		if dels, ok := resMap[rt]; ok {
+			appendStage(rt, dels)
+			delete(resMap, rt)
+		}
+	}
+	for rt, dels := range resMap {
+		appendStage(rt, dels)
+	}
+
+	return sorted
+}
+
+func buildDeletionPlan(stages []PlanStage) *DeletionPlan {
+	return &DeletionPlan{Stages: stages}
+}
@@ -0,0 +1,172 @@
+// Copyright © 2017 grafiti authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gc
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coreos/grafiti/arn"
+	"github.com/coreos/grafiti/deleter"
+)
+
+// fakeDeleter is a deleter.ResourceDeleter double. When used as the per-call
+// deleter handed back by Reconciler.NewDeleter, onDelete (if set) is invoked
+// with the single resource name AddResourceNames was called with.
+type fakeDeleter struct {
+	names    arn.ResourceNames
+	onDelete func(arn.ResourceNames) error
+}
+
+func (f *fakeDeleter) AddResourceNames(ns ...arn.ResourceName) {
+	f.names = append(f.names, ns...)
+}
+
+func (f *fakeDeleter) ResourceNames() arn.ResourceNames {
+	return f.names
+}
+
+func (f *fakeDeleter) DeleteResources(cfg *deleter.DeleteConfig) error {
+	if f.onDelete != nil {
+		return f.onDelete(f.names)
+	}
+	return nil
+}
+
+// TestOrganizeByDelOrderActualDeletionOrder guards against regressing to
+// Plan-order semantics: DeleteOrder is documented as the REVERSE of
+// deletion order, so organizeByDelOrder must walk it back to front. S3
+// buckets have no dependents and must come out first; a VPC, which
+// everything else depends on, must come out last.
+func TestOrganizeByDelOrderActualDeletionOrder(t *testing.T) {
+	r := &Reconciler{}
+
+	resMap := map[arn.ResourceType]deleter.ResourceDeleter{
+		arn.S3BucketRType:    &fakeDeleter{names: arn.ResourceNames{"bucket-1"}},
+		arn.EC2VPCRType:      &fakeDeleter{names: arn.ResourceNames{"vpc-1"}},
+		arn.EC2InstanceRType: &fakeDeleter{names: arn.ResourceNames{"i-1"}},
+	}
+	tagged := map[arn.ResourceType]arn.ResourceNames{
+		arn.S3BucketRType:    {"bucket-1"},
+		arn.EC2VPCRType:      {"vpc-1"},
+		arn.EC2InstanceRType: {"i-1"},
+	}
+
+	stages := r.organizeByDelOrder(resMap, tagged)
+
+	var order []arn.ResourceType
+	for _, s := range stages {
+		order = append(order, s.Type)
+	}
+
+	want := []arn.ResourceType{arn.S3BucketRType, arn.EC2InstanceRType, arn.EC2VPCRType}
+	if !reflect.DeepEqual(order, want) {
+		t.Fatalf("organizeByDelOrder() stage order = %v, want %v (S3 buckets first, VPC last)", order, want)
+	}
+}
+
+// TestRunStageDispatchesConcurrently guards against runStage regressing to
+// a sequential (or otherwise unbounded) loop: it must run up to `workers`
+// deletions at once, never more.
+func TestRunStageDispatchesConcurrently(t *testing.T) {
+	const (
+		resourceCount = 6
+		workers       = 2
+	)
+
+	var (
+		mu      sync.Mutex
+		current int
+		maxSeen int
+	)
+
+	r := &Reconciler{
+		NewDeleter: func(arn.ResourceType) deleter.ResourceDeleter {
+			return &fakeDeleter{
+				onDelete: func(arn.ResourceNames) error {
+					mu.Lock()
+					current++
+					if current > maxSeen {
+						maxSeen = current
+					}
+					mu.Unlock()
+
+					time.Sleep(20 * time.Millisecond)
+
+					mu.Lock()
+					current--
+					mu.Unlock()
+					return nil
+				},
+			}
+		},
+	}
+
+	names := make(arn.ResourceNames, resourceCount)
+	for i := range names {
+		names[i] = arn.ResourceName(string(rune('a' + i)))
+	}
+	stage := PlanStage{Type: arn.EC2InstanceRType, deleters: &fakeDeleter{names: names}}
+
+	result := r.runStage(context.Background(), stage, &deleter.DeleteConfig{}, workers)
+
+	if result.Ok != resourceCount || result.Failed != 0 {
+		t.Fatalf("runStage() = %+v, want Ok=%d Failed=0", result, resourceCount)
+	}
+	if maxSeen > workers {
+		t.Fatalf("observed %d concurrent deletions, want at most workers=%d", maxSeen, workers)
+	}
+	if maxSeen < workers {
+		t.Fatalf("observed only %d concurrent deletions, want runStage to actually dispatch in parallel up to workers=%d", maxSeen, workers)
+	}
+}
+
+// TestRunStageCountsFailuresPerResource guards against runStage collapsing
+// a stage's outcome into an all-or-nothing result: each resource's
+// DeleteResources error must only count against that resource.
+func TestRunStageCountsFailuresPerResource(t *testing.T) {
+	var failed int32
+
+	r := &Reconciler{
+		NewDeleter: func(arn.ResourceType) deleter.ResourceDeleter {
+			return &fakeDeleter{
+				onDelete: func(names arn.ResourceNames) error {
+					if len(names) == 1 && names[0] == "fail-me" {
+						atomic.AddInt32(&failed, 1)
+						return errors.New("boom")
+					}
+					return nil
+				},
+			}
+		},
+	}
+
+	names := arn.ResourceNames{"ok-1", "fail-me", "ok-2"}
+	stage := PlanStage{Type: arn.EC2InstanceRType, deleters: &fakeDeleter{names: names}}
+
+	result := r.runStage(context.Background(), stage, &deleter.DeleteConfig{}, 1)
+
+	if result.Ok != 2 || result.Failed != 1 {
+		t.Fatalf("runStage() = %+v, want Ok=2 Failed=1", result)
+	}
+	if atomic.LoadInt32(&failed) != 1 {
+		t.Fatalf("fake deleter invoked for fail-me %d times, want 1", failed)
+	}
+}
@@ -0,0 +1,123 @@
+// Copyright © 2017 grafiti authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gc
+
+import (
+	"context"
+	"sort"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	rgta "github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi"
+	rgtaiface "github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi/resourcegroupstaggingapiiface"
+)
+
+// fakeRGTA models each resource as the set of tags it carries, and answers
+// GetResources the way the real API does: a call's TagFilters are ANDed
+// together, so a resource must match every filter in a single call to be
+// returned. This lets tests distinguish a combined-AND call (one call, all
+// filters) from the Reconciler's client-side OR emulation (one call per
+// filter, results unioned) - a fake that simply unioned per-key matches
+// regardless of call shape couldn't tell the two apart.
+type fakeRGTA struct {
+	rgtaiface.ResourceGroupsTaggingAPIAPI
+	// tagsByARN maps a resource ARN to the key/value tags it carries.
+	tagsByARN map[string]map[string]string
+}
+
+func (f *fakeRGTA) GetResourcesWithContext(_ aws.Context, in *rgta.GetResourcesInput, _ ...request.Option) (*rgta.GetResourcesOutput, error) {
+	var mappings []*rgta.ResourceTagMapping
+	for a, tags := range f.tagsByARN {
+		if !matchesAllFilters(tags, in.TagFilters) {
+			continue
+		}
+		mappings = append(mappings, &rgta.ResourceTagMapping{ResourceARN: aws.String(a)})
+	}
+	return &rgta.GetResourcesOutput{ResourceTagMappingList: mappings}, nil
+}
+
+// matchesAllFilters reports whether tags satisfies every filter in filters,
+// mirroring RGTA's AND-across-distinct-keys semantics for a single call.
+func matchesAllFilters(tags map[string]string, filters []*rgta.TagFilter) bool {
+	for _, tf := range filters {
+		v, ok := tags[*tf.Key]
+		if !ok {
+			return false
+		}
+		if len(tf.Values) == 0 {
+			continue
+		}
+		matched := false
+		for _, want := range tf.Values {
+			if v == *want {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// TestGetARNsForResourceORUnion verifies that Key=A,Value=1 OR
+// Key=B,Value=2 produces the union of what each filter matches on its own,
+// which is strictly more than the true intersection RGTA's GetResources
+// call returns for a single request containing both filters.
+func TestGetARNsForResourceORUnion(t *testing.T) {
+	const (
+		arnA  = "arn:aws:ec2:us-east-1:1:instance/i-a"
+		arnB  = "arn:aws:ec2:us-east-1:1:instance/i-b"
+		arnAB = "arn:aws:ec2:us-east-1:1:instance/i-ab"
+	)
+
+	rgtaFake := &fakeRGTA{tagsByARN: map[string]map[string]string{
+		arnA:  {"A": "1"},
+		arnB:  {"B": "2"},
+		arnAB: {"A": "1", "B": "2"},
+	}}
+
+	filters := []*rgta.TagFilter{
+		{Key: aws.String("A"), Values: aws.StringSlice([]string{"1"})},
+		{Key: aws.String("B"), Values: aws.StringSlice([]string{"2"})},
+	}
+
+	or := &Reconciler{RGTA: rgtaFake, MatchMode: MatchModeOr}
+	got := or.getARNsForResourceOR(context.Background(), filters, nil)
+
+	var gotStrs []string
+	for _, a := range got {
+		gotStrs = append(gotStrs, string(a))
+	}
+	sort.Strings(gotStrs)
+
+	want := []string{arnA, arnAB, arnB}
+	if len(gotStrs) != len(want) {
+		t.Fatalf("getARNsForResourceOR() = %v, want union %v", gotStrs, want)
+	}
+	for i := range want {
+		if gotStrs[i] != want[i] {
+			t.Errorf("getARNsForResourceOR()[%d] = %s, want %s", i, gotStrs[i], want[i])
+		}
+	}
+
+	and := &Reconciler{RGTA: rgtaFake, MatchMode: MatchModeAnd}
+	gotAnd := and.getARNsForResource(context.Background(), filters, nil)
+	if len(gotAnd) != 1 || string(gotAnd[0]) != arnAB {
+		t.Fatalf("getARNsForResource() (AND) = %v, want intersection [%s]", gotAnd, arnAB)
+	}
+}